@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/rpc"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/avabot/ava/shared/datatypes"
+	"github.com/avabot/ava/shared/httpsignature"
+	"github.com/avabot/ava/shared/macaroon"
 	"github.com/avabot/ava/shared/pkg"
+	"github.com/avabot/ava/shared/ratelimit"
 )
 
 type Ava int
@@ -16,9 +25,135 @@ type Ava int
 var regPkgs map[string]*pkg.PkgWrapper = map[string]*pkg.PkgWrapper{}
 var client *rpc.Client
 
+// macaroonRootKey seeds every package-scoped macaroon minted in callPkg. It
+// must match the root key auth.Purchase verifies a package's macaroon with
+// (both read AVA_MACAROON_ROOT_KEY). Third-party caveat discharges are not
+// checked with it; macaroon.Verify looks up their keys by VID.
+var macaroonRootKey = []byte(os.Getenv("AVA_MACAROON_ROOT_KEY"))
+
+// keystore resolves a registering package's keyID to the Verifier that
+// checks its signature. In production it's backed by the package_keys table;
+// otherwise it's a StaticKeystore seeded from AVA_PKG_SIGNING_KEYS, a JSON
+// object mapping keyID to secret, for local development.
+var keystore httpsignature.Keystore
+
+// defaultPkgPriceMaxCents caps how much a package's macaroon authorizes it to
+// charge on the user's behalf, via the price_max< caveat mintPkgMacaroon
+// adds. AVA_PKG_PRICE_MAX_CENTS overrides it per deployment.
+const defaultPkgPriceMaxCents = 10000
+
+var pkgPriceMaxCents = defaultPkgPriceMaxCents
+
+func init() {
+	if len(macaroonRootKey) == 0 {
+		log.Fatal("AVA_MACAROON_ROOT_KEY must be set")
+	}
+	if v := os.Getenv("AVA_PKG_PRICE_MAX_CENTS"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatal("invalid AVA_PKG_PRICE_MAX_CENTS: ", err)
+		}
+		pkgPriceMaxCents = n
+	}
+	keystore = newKeystore()
+	if err := loadRateLimiters(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadRateLimiters overrides userLimiter/routeLimiter/pkgLimiter's quotas
+// from env, if set, so deployments can tune them without a redeploy.
+func loadRateLimiters() error {
+	userQuota, err := ratelimit.LoadQuota("AVA_USER_RATE_BURST",
+		"AVA_USER_RATE_REQUESTS", "AVA_USER_RATE_SECONDS",
+		ratelimit.DefaultUserQuota)
+	if err != nil {
+		return err
+	}
+	routeQuota, err := ratelimit.LoadQuota("AVA_ROUTE_RATE_BURST",
+		"AVA_ROUTE_RATE_REQUESTS", "AVA_ROUTE_RATE_SECONDS",
+		ratelimit.DefaultRouteQuota)
+	if err != nil {
+		return err
+	}
+	pkgQuota, err := ratelimit.LoadQuota("AVA_PKG_RATE_BURST",
+		"AVA_PKG_RATE_REQUESTS", "AVA_PKG_RATE_SECONDS",
+		ratelimit.DefaultPkgQuota)
+	if err != nil {
+		return err
+	}
+	userLimiter = ratelimit.NewLimiter(userQuota)
+	routeLimiter = ratelimit.NewLimiter(routeQuota)
+	pkgLimiter = ratelimit.NewLimiter(pkgQuota)
+	return nil
+}
+
+// newKeystore builds the Keystore package registration and call signing is
+// verified against: the package_keys table in production (so keys can be
+// rotated without a redeploy), or a StaticKeystore seeded from
+// AVA_PKG_SIGNING_KEYS for local development.
+func newKeystore() httpsignature.Keystore {
+	if os.Getenv("AVA_ENV") == "production" {
+		return httpsignature.NewDBKeystore(db)
+	}
+	raw := os.Getenv("AVA_PKG_SIGNING_KEYS")
+	if len(raw) == 0 {
+		log.Println("warn: AVA_PKG_SIGNING_KEYS not set - no packages will " +
+			"be able to register")
+		return httpsignature.NewStaticKeystore(nil)
+	}
+	var keys map[string]string
+	if err := json.Unmarshal([]byte(raw), &keys); err != nil {
+		log.Fatal("invalid AVA_PKG_SIGNING_KEYS: ", err)
+	}
+	secrets := make(map[string][]byte, len(keys))
+	for keyID, secret := range keys {
+		secrets[keyID] = []byte(secret)
+	}
+	return httpsignature.NewStaticKeystore(secrets)
+}
+
+// userLimiter throttles how often a single user can trigger a package call at
+// all; routeLimiter additionally throttles a single (user, route) pair;
+// pkgLimiter throttles a single package across every user and route. Between
+// them, neither a Trigger collision nor a looping SMS conversation nor a
+// single popular package can hammer a package's RPC endpoint or the services
+// behind it (e.g. Stripe). Quotas are overridable via env - see
+// loadRateLimiters.
+var userLimiter = ratelimit.NewLimiter(ratelimit.DefaultUserQuota)
+var routeLimiter = ratelimit.NewLimiter(ratelimit.DefaultRouteQuota)
+var pkgLimiter = ratelimit.NewLimiter(ratelimit.DefaultPkgQuota)
+
+// rateLimitDenied counts requests callPkg has turned away for exceeding a
+// rate limit, for monitoring.
+var rateLimitDenied uint64
+
+const rateLimitSentence = "Slow down! You're sending requests too quickly."
+
 // RegisterPackage enables Ava to notify packages when specific StructuredInput
 // is encountered. Note that packages will only listen when ALL criteria are met
 func (t *Ava) RegisterPackage(p *pkg.Pkg, reply *string) error {
+	_, verifier, err := keystore.LookupVerifier(context.Background(),
+		p.Config.KeyID)
+	if err != nil {
+		log.Println("err: unknown package key id", p.Config.KeyID)
+		return err
+	}
+	digest := httpsignature.Digest(p.CanonicalBytes())
+	if err := verifier.Verify(digest, p.Signature); err != nil {
+		log.Println("err: rejecting unsigned/invalid registration from",
+			p.Config.Name)
+		return err
+	}
+	// signator signs every outgoing call Ava makes to this package. It's
+	// derived from the same per-package secret as verifier, so a
+	// compromised package only ever learns the key used to talk to it,
+	// not the keys used to talk to every other registered package.
+	signator, err := keystore.LookupSignator(context.Background(), p.Config.KeyID)
+	if err != nil {
+		log.Println("err: unknown package key id", p.Config.KeyID)
+		return err
+	}
 	pt := p.Config.Port + 1
 	log.Println("registering package with listen port", pt)
 	port := ":" + strconv.Itoa(pt)
@@ -28,6 +163,13 @@ func (t *Ava) RegisterPackage(p *pkg.Pkg, reply *string) error {
 		log.Println("BUG HERE")
 		return err
 	}
+	pw := &pkg.PkgWrapper{
+		P:         p,
+		RPCClient: cl,
+		KeyID:     p.Config.KeyID,
+		Verifier:  verifier,
+		Signator:  signator,
+	}
 	for _, c := range p.Trigger.Commands {
 		c = strings.ToLower(c)
 		for _, o := range p.Trigger.Objects {
@@ -37,100 +179,221 @@ func (t *Ava) RegisterPackage(p *pkg.Pkg, reply *string) error {
 					"warn: duplicate package or trigger",
 					p.Config.Name, s)
 			}
-			regPkgs[s] = &pkg.PkgWrapper{P: p, RPCClient: cl}
+			regPkgs[s] = pw
 		}
-		regPkgs[c] = &pkg.PkgWrapper{P: p, RPCClient: cl}
+		regPkgs[c] = pw
 	}
 	return nil
 }
 
-func getPkg(m *datatypes.Message) (*pkg.PkgWrapper, string, bool, error) {
-	var p *pkg.PkgWrapper
+// signMessage returns a copy of m carrying a fresh Signature/Date/Digest
+// envelope, computed by pw.Signator over a canonicalized, header-free m, so
+// the receiving package can verify the call came from Ava core rather than
+// trusting it by virtue of arriving on localhost. It never mutates m itself:
+// callPkg reuses the same *datatypes.Message across fallback candidates, and
+// signing in place would bake one candidate's stale headers into the digest
+// computed for the next.
+func signMessage(pw *pkg.PkgWrapper, m *datatypes.Message) (*datatypes.Message, error) {
+	cp := *m
+	cp.SignatureHeaders = nil
+	payload, err := json.Marshal(&cp)
+	if err != nil {
+		return nil, err
+	}
+	digest := httpsignature.Digest(payload)
+	sig, err := pw.Signator.Sign(digest)
+	if err != nil {
+		return nil, err
+	}
+	cp.SignatureHeaders = &httpsignature.Headers{
+		KeyID:     pw.Signator.KeyID(),
+		Signature: sig,
+		Date:      time.Now().UTC().Format(time.RFC1123),
+		Digest:    digest,
+	}
+	return &cp, nil
+}
+
+// verifyReply checks that reply was signed by pw's Verifier, i.e. the
+// package that answered the call really is the one Ava registered and
+// dialed, and not an arbitrary process that happens to be listening at the
+// dialed address.
+func verifyReply(pw *pkg.PkgWrapper, reply *datatypes.ResponseMsg) error {
+	hdrs := reply.SignatureHeaders
+	if hdrs == nil {
+		return errors.New("rpc: unsigned reply from " + pw.P.Config.Name)
+	}
+	cp := *reply
+	cp.SignatureHeaders = nil
+	payload, err := json.Marshal(&cp)
+	if err != nil {
+		return err
+	}
+	digest := httpsignature.Digest(payload)
+	return pw.Verifier.Verify(digest, hdrs.Signature)
+}
+
+// pkgCandidate is one package that might handle a message, in the priority
+// order getPkgCandidates found it: an exact command_object route, then a
+// bare-object short route, then a bare-command route, then the route of the
+// last response sent to this user.
+type pkgCandidate struct {
+	pw        *pkg.PkgWrapper
+	route     string
+	lastRoute bool
+}
+
+// getPkgCandidates returns, in priority order, every package that could
+// plausibly handle m. callPkg tries them in turn so that a package which
+// partially matches but isn't actually the right handler (pkg.ErrNotHandled)
+// doesn't shadow a better candidate further down the list.
+func getPkgCandidates(m *datatypes.Message) ([]pkgCandidate, error) {
 	if m.User == nil {
-		p = regPkgs["onboard"]
-		if p != nil {
-			return p, "onboard", false, nil
-		} else {
+		p := regPkgs["onboard"]
+		if p == nil {
 			log.Println("err: missing required onboard package")
-			return nil, "onboard", false, ErrMissingPackage
+			return nil, ErrMissingPackage
 		}
+		return []pkgCandidate{{pw: p, route: "onboard"}}, nil
 	}
-	var route string
-	var shortRoute string
+	var cands []pkgCandidate
+	seen := map[string]bool{}
+	add := func(p *pkg.PkgWrapper, route string, lastRoute bool) {
+		if p == nil || len(route) == 0 || seen[route] {
+			return
+		}
+		seen[route] = true
+		cands = append(cands, pkgCandidate{pw: p, route: route, lastRoute: lastRoute})
+	}
+	var exactRoute, shortRoute, cmdRoute string
+	var exactPw, shortPw, cmdPw *pkg.PkgWrapper
 	si := m.Input.StructuredInput
 Loop:
 	for _, c := range si.Commands {
 		c = strings.Split(c, "'")[0]
 		for _, o := range si.Objects {
 			o = strings.Split(o, "'")[0]
-			route = strings.ToLower(c + "_" + o)
-			p = regPkgs[route]
-			log.Println("searching for " + strings.ToLower(c+"_"+o))
-			if p != nil {
-				shortRoute = ""
+			r := strings.ToLower(c + "_" + o)
+			log.Println("searching for " + r)
+			if p := regPkgs[r]; p != nil {
+				exactRoute, exactPw = r, p
 				break Loop
 			}
-			p = regPkgs[o]
-			if p != nil {
-				shortRoute = o
+			if p := regPkgs[o]; p != nil && shortPw == nil {
+				shortRoute, shortPw = o, p
 			}
 		}
-		p = regPkgs[c]
-		if p != nil {
-			shortRoute = c
+		if p := regPkgs[c]; p != nil && cmdPw == nil {
+			cmdRoute, cmdPw = c, p
 		}
 	}
-	if len(shortRoute) > 0 {
-		route = shortRoute
-	}
-	if p == nil {
-		log.Println("p is nil, getting last response route")
-		if err := m.GetLastResponse(db); err != nil {
-			return p, route, false, err
-		}
-		if m.LastResponse == nil {
-			log.Println("couldn't find last package")
-			return p, route, false, ErrMissingPackage
-		}
-		route = m.LastResponse.Route
-		p = regPkgs[route]
-		if p == nil {
-			return p, route, true, ErrMissingPackage
+	add(exactPw, exactRoute, false)
+	add(shortPw, shortRoute, false)
+	add(cmdPw, cmdRoute, false)
+	log.Println("getting last response route")
+	if err := m.GetLastResponse(db); err != nil {
+		if len(cands) == 0 {
+			return nil, err
 		}
+		log.Println("err: getting last response:", err)
+	} else if m.LastResponse != nil {
+		route := m.LastResponse.Route
 		// TODO pass LastResponse directly to packages via rpc gob
 		// encoding, removing the need to nil this out and then look it
 		// up again in the package
 		m.LastResponse = nil
-		return p, route, false, nil
-	} else {
-		return p, route, false, nil
+		add(regPkgs[route], route, true)
 	}
+	if len(cands) == 0 {
+		log.Println("couldn't find last package")
+		return nil, ErrMissingPackage
+	}
+	return cands, nil
 }
 
+// callPkg dispatches m to the first candidate package that actually handles
+// it. A candidate returning pkg.ErrNotHandled means "not mine" and dispatch
+// falls through to the next candidate (route -> shortRoute -> last-response
+// route); any other error is authoritative and short-circuits dispatch.
 func callPkg(m *datatypes.Message, ctxAdded bool) (*datatypes.ResponseMsg,
 	string, string, error) {
 	reply := &datatypes.ResponseMsg{}
-	pw, route, lastRoute, err := getPkg(m)
+	if m.User != nil && !userLimiter.Allow(strconv.Itoa(m.User.ID)) {
+		atomic.AddUint64(&rateLimitDenied, 1)
+		reply.Sentence = rateLimitSentence
+		return reply, "", "", nil
+	}
+	cands, err := getPkgCandidates(m)
 	if err != nil {
-		var pname string
-		if pw != nil {
-			pname = pw.P.Config.Name
+		return reply, "", "", err
+	}
+	for _, cand := range cands {
+		reply = &datatypes.ResponseMsg{}
+		if m.User != nil {
+			key := strconv.Itoa(m.User.ID) + "|" + cand.route
+			if !routeLimiter.Allow(key) {
+				atomic.AddUint64(&rateLimitDenied, 1)
+				reply.Sentence = rateLimitSentence
+				return reply, cand.pw.P.Config.Name, cand.route, nil
+			}
+		}
+		if !pkgLimiter.Allow(cand.pw.P.Config.Name) {
+			atomic.AddUint64(&rateLimitDenied, 1)
+			reply.Sentence = rateLimitSentence
+			return reply, cand.pw.P.Config.Name, cand.route, nil
+		}
+		log.Println("sending structured input to", cand.pw.P.Config.Name)
+		c := strings.Title(cand.pw.P.Config.Name)
+		if ctxAdded || cand.lastRoute || len(m.Input.StructuredInput.Commands) == 0 {
+			log.Println("FollowUp")
+			c += ".FollowUp"
+		} else {
+			c += ".Run"
+		}
+		m.Route = cand.route
+		m.Root = mintPkgMacaroon(m, cand.route)
+		signed, serr := signMessage(cand.pw, m)
+		if serr != nil {
+			return reply, cand.pw.P.Config.Name, cand.route, serr
+		}
+		log.Println("calling pkg with", fmt.Sprintf("%+v", signed))
+		err = cand.pw.RPCClient.Call(c, signed, reply)
+		if err == nil {
+			if verr := verifyReply(cand.pw, reply); verr != nil {
+				log.Println("err: rejecting unsigned/invalid reply from",
+					cand.pw.P.Config.Name)
+				return reply, cand.pw.P.Config.Name, cand.route, verr
+			}
+			return reply, cand.pw.P.Config.Name, cand.route, nil
+		}
+		// net/rpc hands a package's error back as an rpc.ServerError
+		// holding only its message, so match the sentinel by message.
+		if err.Error() == pkg.ErrNotHandled.Error() {
+			log.Println(cand.pw.P.Config.Name, "did not handle",
+				cand.route, "- trying next candidate")
+			continue
 		}
-		return reply, pname, route, err
-	}
-	log.Println("sending structured input to", pw.P.Config.Name)
-	c := strings.Title(pw.P.Config.Name)
-	if ctxAdded || lastRoute || len(m.Input.StructuredInput.Commands) == 0 {
-		log.Println("FollowUp")
-		c += ".FollowUp"
-	} else {
-		c += ".Run"
-	}
-	m.Route = route
-	log.Println("calling pkg with", fmt.Sprintf("%+v", m))
-	if err := pw.RPCClient.Call(c, m, reply); err != nil {
 		log.Println("invalid response")
-		return reply, pw.P.Config.Name, route, err
+		return reply, cand.pw.P.Config.Name, cand.route, err
 	}
-	return reply, pw.P.Config.Name, route, nil
-}
\ No newline at end of file
+	log.Println("no candidate handled the input")
+	return reply, "", "", ErrMissingPackage
+}
+
+// mintPkgMacaroon grants the package handling route a narrowly-scoped,
+// time-bounded capability to act on m.User's behalf, rather than the package
+// inheriting Ava's full session trust. The package must present this
+// macaroon (plus any discharges a third-party caveat requires, e.g. from the
+// auth package) back on subsequent calls that spend it.
+func mintPkgMacaroon(m *datatypes.Message, route string) *macaroon.Macaroon {
+	if m.User == nil {
+		return nil
+	}
+	expires := time.Now().Add(5 * time.Minute).Unix()
+	mac := macaroon.New(macaroonRootKey, "ava", strconv.Itoa(m.User.ID))
+	mac = mac.WithFirstPartyCaveat(fmt.Sprintf("user_id=%d", m.User.ID))
+	mac = mac.WithFirstPartyCaveat(fmt.Sprintf("route=%s", route))
+	mac = mac.WithFirstPartyCaveat(fmt.Sprintf("expires<%d", expires))
+	mac = mac.WithFirstPartyCaveat(fmt.Sprintf("price_max<%d", pkgPriceMaxCents))
+	return mac
+}
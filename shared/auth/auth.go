@@ -5,18 +5,35 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/avabot/ava/Godeps/_workspace/src/github.com/jmoiron/sqlx"
 	"github.com/avabot/ava/Godeps/_workspace/src/github.com/stripe/stripe-go"
 	"github.com/avabot/ava/Godeps/_workspace/src/github.com/stripe/stripe-go/charge"
 	"github.com/avabot/ava/Godeps/_workspace/src/github.com/subosito/twilio"
 	"github.com/avabot/ava/shared/datatypes"
+	"github.com/avabot/ava/shared/macaroon"
 	"github.com/avabot/ava/shared/mail"
 	"github.com/avabot/ava/shared/sms"
 )
 
 var regexNum = regexp.MustCompile(`\d+`)
 
+// ErrDailyLimitExceeded is returned by Purchase when charging price would put
+// the user over their rolling 24h spend cap (AVA_DAILY_LIMIT_CENTS).
+var ErrDailyLimitExceeded = errors.New("auth: daily spend limit exceeded")
+
+// ErrInvalidMacaroon is returned by Purchase when the package-scoped
+// macaroon the caller presents is missing, forged, expired, or doesn't
+// authorize this user/route/price - i.e. the capability callPkg handed the
+// package doesn't actually cover what it's trying to do.
+var ErrInvalidMacaroon = errors.New("auth: invalid or insufficient macaroon")
+
+// macaroonRootKey must match the key rpc.go's mintPkgMacaroon signs package
+// capability tokens with, so Purchase can verify the one a package presents.
+var macaroonRootKey = []byte(os.Getenv("AVA_MACAROON_ROOT_KEY"))
+
 const (
 	// MethodCVV will require the CVV (3-4 digit security code) for a credit
 	// card on file. If the user has no credit cards on file, the user will
@@ -41,6 +58,14 @@ const (
 	// as it ensures no one has stolen the device or session token of a
 	// user.
 	MethodWebLogin
+
+	// MethodOAuth requires the user complete an OAuth2/OIDC login with a
+	// linked external provider (Google, GitHub, Facebook) rather than
+	// typing a zip/CVV over SMS. The SMS confirmation includes a signed,
+	// short-lived link that starts the flow; authentication completes
+	// when the provider redirects back to our callback with a successful
+	// authorization. See oauth.go for the provider registry and handlers.
+	MethodOAuth
 )
 
 // RequestAuth ensures you're speaking to the correct user. Select the LOWEST
@@ -77,6 +102,8 @@ func RequestAuth(db *sqlx.DB, tc *twilio.Client, m dt.Method, msg *dt.Msg) (
 			return false, err
 		}
 		t = "Please log in to prove it's you: https://www.avabot.com/?/login"
+	case MethodOAuth:
+		t = "Please verify your identity by logging in"
 	}
 	tx, err := db.Beginx()
 	if err != nil {
@@ -94,6 +121,13 @@ func RequestAuth(db *sqlx.DB, tc *twilio.Client, m dt.Method, msg *dt.Msg) (
 	if err = tx.Commit(); err != nil {
 		return false, err
 	}
+	if m == MethodOAuth {
+		link, err := buildOAuthLink(aid)
+		if err != nil {
+			return false, err
+		}
+		t += ": " + link
+	}
 	if msg.Input.FlexIDType == 2 {
 		if err = sms.SendMessage(tc, msg.Input.FlexID, t); err != nil {
 			return false, err
@@ -106,9 +140,28 @@ func RequestAuth(db *sqlx.DB, tc *twilio.Client, m dt.Method, msg *dt.Msg) (
 	return false, nil
 }
 
-// Purchase will authenticate the user and then charge a card.
+// Purchase verifies the package-scoped macaroon root that callPkg minted for
+// route (requiring it actually authorizes this user, route, and price, and
+// hasn't expired), authenticates the user, and then charges a card. root is
+// the capability callPkg attached to the dispatched message as m.Root; a
+// package calls Purchase with the same root it was handed rather than any
+// session of its own, so a compromised package can't charge a user it was
+// never dispatched to, or for more than the call it was dispatched for
+// authorized.
 func Purchase(db *sqlx.DB, tc *twilio.Client, sg *mail.Client, m dt.Method,
-	msg *dt.Msg, prds []dt.Product, price uint64) error {
+	msg *dt.Msg, prds []dt.Product, price uint64, root *macaroon.Macaroon,
+	route string) error {
+	if root == nil {
+		return ErrInvalidMacaroon
+	}
+	err := macaroon.Verify(macaroonRootKey, root, nil, nil,
+		macaroon.UserIDCheck(msg.User.ID),
+		macaroon.RouteCheck(route),
+		macaroon.ExpiresCheck(time.Now()),
+		macaroon.PriceMaxCheck(price))
+	if err != nil {
+		return ErrInvalidMacaroon
+	}
 	if os.Getenv("AVA_ENV") == "production" {
 		authenticated, err := RequestAuth(db, tc, m, msg)
 		if err != nil {
@@ -119,6 +172,36 @@ func Purchase(db *sqlx.DB, tc *twilio.Client, sg *mail.Client, m dt.Method,
 		}
 	}
 	desc := fmt.Sprintf("Purchase for %.2f", price)
+	// Hold a per-user advisory lock only across the limit check and
+	// reserving the charge, so two concurrent purchases can't both read
+	// the same pre-charge spend total and both slip under
+	// AVA_DAILY_LIMIT_CENTS. The lock (and the transaction) is released
+	// before the blocking call to Stripe below, so a slow Stripe request
+	// doesn't serialize every other purchase this user makes or tie up a
+	// DB connection for its duration.
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, msg.User.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := checkDailyLimit(tx, msg.User.ID, price); err != nil {
+		tx.Rollback()
+		return err
+	}
+	q := `
+		INSERT INTO charges (userid, amount, description)
+		VALUES ($1, $2, $3) RETURNING id`
+	var chargeID int
+	if err := tx.QueryRowx(q, msg.User.ID, price, desc).Scan(&chargeID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 	stripe.Key = os.Getenv("STRIPE_ACCESS_TOKEN")
 	chargeParams := &stripe.ChargeParams{
 		Amount:   price,
@@ -126,12 +209,53 @@ func Purchase(db *sqlx.DB, tc *twilio.Client, sg *mail.Client, m dt.Method,
 		Desc:     desc,
 		Customer: msg.User.StripeCustomerID,
 	}
-	if _, err := charge.New(chargeParams); err != nil {
+	ch, err := charge.New(chargeParams)
+	if err != nil {
+		q := `DELETE FROM charges WHERE id=$1`
+		if _, derr := db.Exec(q, chargeID); derr != nil {
+			return fmt.Errorf("%v (also failed to release reservation: %v)",
+				err, derr)
+		}
+		return err
+	}
+	q = `UPDATE charges SET stripechargeid=$1 WHERE id=$2`
+	if _, err := db.Exec(q, ch.ID, chargeID); err != nil {
+		return err
+	}
+	if err := sg.SendPurchaseConfirmation(prds, price, msg.User); err != nil {
 		return err
 	}
-	err := sg.SendPurchaseConfirmation(prds, price, msg.User)
+	return nil
+}
+
+// dailySpendGetter is satisfied by both *sqlx.DB and *sqlx.Tx, so
+// checkDailyLimit can run either standalone or inside Purchase's advisory-
+// locked transaction.
+type dailySpendGetter interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+}
+
+// checkDailyLimit refuses a charge that would push userID's spend over the
+// last 24h above AVA_DAILY_LIMIT_CENTS. If that env var isn't set, no limit
+// is enforced.
+func checkDailyLimit(db dailySpendGetter, userID int, price uint64) error {
+	limit := os.Getenv("AVA_DAILY_LIMIT_CENTS")
+	if len(limit) == 0 {
+		return nil
+	}
+	limitCents, err := strconv.ParseUint(limit, 10, 64)
 	if err != nil {
+		return fmt.Errorf("auth: invalid AVA_DAILY_LIMIT_CENTS: %v", err)
+	}
+	var spent uint64
+	q := `
+		SELECT COALESCE(SUM(amount), 0) FROM charges
+		WHERE userid=$1 AND createdat > now() - interval '24 hours'`
+	if err := db.Get(&spent, q, userID); err != nil {
 		return err
 	}
+	if spent+price > limitCents {
+		return ErrDailyLimitExceeded
+	}
 	return nil
 }
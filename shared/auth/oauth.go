@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avabot/ava/Godeps/_workspace/src/github.com/jmoiron/sqlx"
+	"github.com/avabot/ava/Godeps/_workspace/src/github.com/labstack/echo"
+	"github.com/avabot/ava/Godeps/_workspace/src/golang.org/x/oauth2"
+	"github.com/avabot/ava/shared/datatypes"
+)
+
+// Provider describes an OAuth2/OIDC identity provider (Google, GitHub,
+// Facebook, ...) that a user may link to their Ava account in order to
+// authenticate via MethodOAuth instead of a card zip/CVV.
+type Provider struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	Scopes       []string
+}
+
+var providers = map[string]*Provider{}
+
+// RegisterProvider adds an OAuth2/OIDC provider to the registry. Call this at
+// startup for each provider configured in AVA_OAUTH_PROVIDERS.
+func RegisterProvider(p *Provider) {
+	providers[p.Name] = p
+}
+
+// GetProvider returns the registered provider by name, or nil if no provider
+// is registered under that name.
+func GetProvider(name string) *Provider {
+	return providers[name]
+}
+
+func (p *Provider) config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Scopes:       p.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.AuthURL,
+			TokenURL: p.TokenURL,
+		},
+		RedirectURL: fmt.Sprintf(
+			"https://www.avabot.com/auth/oauth/%s/callback", p.Name),
+	}
+}
+
+// OAuthLoginHandler redirects the user to the provider's consent screen. It
+// expects a signed "token" query param identifying the pending authorization
+// created by RequestAuth with MethodOAuth, and reuses that same token as the
+// OAuth state to protect against CSRF.
+func OAuthLoginHandler(db *sqlx.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		p := GetProvider(c.Param("provider"))
+		if p == nil {
+			return c.String(http.StatusNotFound, "unknown provider")
+		}
+		token := c.Query("token")
+		if _, err := verifyOAuthToken(token, p.Name); err != nil {
+			return c.String(http.StatusForbidden, "invalid or expired link")
+		}
+		return c.Redirect(http.StatusFound, p.config().AuthCodeURL(token))
+	}
+}
+
+// OAuthCallbackHandler exchanges the authorization code for a token, fetches
+// the user's external identity, links it to the pending authorizationid, and
+// marks that authorization satisfied.
+func OAuthCallbackHandler(db *sqlx.DB) echo.HandlerFunc {
+	return func(c *echo.Context) error {
+		p := GetProvider(c.Param("provider"))
+		if p == nil {
+			return c.String(http.StatusNotFound, "unknown provider")
+		}
+		aid, err := verifyOAuthToken(c.Query("state"), p.Name)
+		if err != nil {
+			return c.String(http.StatusForbidden, "invalid or expired link")
+		}
+		tok, err := p.config().Exchange(oauth2.NoContext, c.Query("code"))
+		if err != nil {
+			return err
+		}
+		extID, err := fetchExternalID(p, tok)
+		if err != nil {
+			return err
+		}
+		if err := completeOAuth(db, aid, p.Name, extID, tok); err != nil {
+			return err
+		}
+		return c.String(http.StatusOK,
+			"You're verified. You can return to Ava now.")
+	}
+}
+
+// fetchExternalID calls the provider's UserInfoURL with the newly obtained
+// token and extracts a stable external identifier for the user.
+func fetchExternalID(p *Provider, tok *oauth2.Token) (string, error) {
+	client := p.config().Client(oauth2.NoContext, tok)
+	resp, err := client.Get(p.UserInfoURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var info struct {
+		ID  string `json:"id"`
+		Sub string `json:"sub"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	if len(info.ID) > 0 {
+		return info.ID, nil
+	}
+	if len(info.Sub) > 0 {
+		return info.Sub, nil
+	}
+	return "", errors.New("provider did not return an external id")
+}
+
+// completeOAuth links the external identity to the user pending authorization
+// aid and marks that authorization as satisfied.
+func completeOAuth(db *sqlx.DB, aid int, provider, externalID string,
+	tok *oauth2.Token) error {
+	var u dt.User
+	q := `SELECT id FROM users WHERE authorizationid=$1`
+	if err := db.Get(&u, q, aid); err != nil {
+		return err
+	}
+	if err := LinkExternalAccount(db, &u, provider, externalID, tok); err != nil {
+		return err
+	}
+	q = `UPDATE authorizations SET authenticatedat=now() WHERE id=$1`
+	_, err := db.Exec(q, aid)
+	return err
+}
+
+// LinkExternalAccount associates an external OAuth2/OIDC identity with u,
+// storing the provider's access and refresh tokens for later use.
+func LinkExternalAccount(db *sqlx.DB, u *dt.User, provider, externalID string,
+	tok *oauth2.Token) error {
+	q := `
+		INSERT INTO external_login_users
+			(provider, external_id, user_id, access_token, refresh_token,
+			 expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (provider, external_id)
+		DO UPDATE SET access_token=$4, refresh_token=$5, expires_at=$6`
+	_, err := db.Exec(q, provider, externalID, u.ID, tok.AccessToken,
+		tok.RefreshToken, tok.Expiry)
+	return err
+}
+
+// UnlinkExternalAccount removes a previously linked external identity from u.
+func UnlinkExternalAccount(db *sqlx.DB, u *dt.User, provider string) error {
+	q := `DELETE FROM external_login_users WHERE user_id=$1 AND provider=$2`
+	_, err := db.Exec(q, u.ID, provider)
+	return err
+}
+
+// buildOAuthLink returns a signed, short-lived login URL for the default
+// OAuth provider (AVA_OAUTH_DEFAULT_PROVIDER) bound to the pending
+// authorization aid.
+func buildOAuthLink(aid int) (string, error) {
+	name := os.Getenv("AVA_OAUTH_DEFAULT_PROVIDER")
+	if len(name) == 0 {
+		return "", errors.New("auth: AVA_OAUTH_DEFAULT_PROVIDER not set")
+	}
+	token, err := signOAuthToken(aid, name)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://www.avabot.com/auth/oauth/%s/login?token=%s",
+		name, token), nil
+}
+
+// signOAuthToken signs (aid, provider) with AVA_SIGNING_SECRET so it can be
+// safely embedded in an SMS link and later recovered by verifyOAuthToken.
+// Binding provider into the signed payload, rather than trusting the
+// provider named in the URL path, stops the link from verifying against a
+// different provider than the one the user was told they'd authenticate
+// with.
+func signOAuthToken(aid int, provider string) (string, error) {
+	secret := os.Getenv("AVA_SIGNING_SECRET")
+	if len(secret) == 0 {
+		return "", errors.New("auth: AVA_SIGNING_SECRET not set")
+	}
+	exp := time.Now().Add(15 * time.Minute).Unix()
+	payload := fmt.Sprintf("%d.%s.%d", aid, provider, exp)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	sig := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	return base64.URLEncoding.EncodeToString([]byte(payload)) + "." + sig, nil
+}
+
+// verifyOAuthToken checks the signature, expiry, and bound provider of a
+// token produced by signOAuthToken and returns the authorizationid it was
+// signed for. provider must match the one the token was signed with, so a
+// token minted for one provider's login/callback URL can't be replayed
+// against another's.
+func verifyOAuthToken(token, provider string) (int, error) {
+	secret := os.Getenv("AVA_SIGNING_SECRET")
+	if len(secret) == 0 {
+		return 0, errors.New("auth: AVA_SIGNING_SECRET not set")
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return 0, errors.New("auth: malformed oauth token")
+	}
+	payloadB, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, errors.New("auth: malformed oauth token")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payloadB)
+	expected := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return 0, errors.New("auth: invalid oauth token signature")
+	}
+	payload := strings.SplitN(string(payloadB), ".", 3)
+	if len(payload) != 3 {
+		return 0, errors.New("auth: malformed oauth token")
+	}
+	aid, err := strconv.Atoi(payload[0])
+	if err != nil {
+		return 0, errors.New("auth: malformed oauth token")
+	}
+	if payload[1] != provider {
+		return 0, errors.New("auth: oauth token bound to a different provider")
+	}
+	exp, err := strconv.ParseInt(payload[2], 10, 64)
+	if err != nil {
+		return 0, errors.New("auth: malformed oauth token")
+	}
+	if time.Now().Unix() > exp {
+		return 0, errors.New("auth: oauth token expired")
+	}
+	return aid, nil
+}
@@ -0,0 +1,166 @@
+// Package httpsignature signs and verifies the RPC calls Ava core exchanges
+// with out-of-process packages, so that arriving on localhost is no longer
+// sufficient to be trusted. Each registered package is associated with a
+// keyID and a Verifier in a Keystore, and every request/response is signed by
+// a Signator over a canonicalized payload digest, modeled loosely on
+// draft-cavage-http-signatures (Signature/Date/Digest).
+package httpsignature
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/avabot/ava/Godeps/_workspace/src/github.com/jmoiron/sqlx"
+)
+
+// ErrUnknownKey is returned by a Keystore when keyID names no known Verifier.
+var ErrUnknownKey = errors.New("httpsignature: unknown key id")
+
+// ErrInvalidSignature is returned when a signature doesn't verify against the
+// digest it claims to cover.
+var ErrInvalidSignature = errors.New("httpsignature: invalid signature")
+
+// Verifier checks a signature computed over digest.
+type Verifier interface {
+	Verify(digest, signature []byte) error
+}
+
+// Signator signs a digest on behalf of KeyID.
+type Signator interface {
+	KeyID() string
+	Sign(digest []byte) ([]byte, error)
+}
+
+// Keystore resolves a keyID, as presented on an incoming call, to the
+// Verifier that can check its signature, and (for the same keyID, when this
+// process also needs to sign outgoing calls to that package) the Signator
+// derived from the same secret. ctx is threaded through LookupVerifier (and
+// may be enriched, e.g. with the matched package record) so callers don't
+// need a second lookup.
+type Keystore interface {
+	LookupVerifier(ctx context.Context, keyID string) (context.Context, Verifier, error)
+	LookupSignator(ctx context.Context, keyID string) (Signator, error)
+}
+
+// Headers is the signature envelope attached to a signed call.
+type Headers struct {
+	KeyID     string
+	Signature []byte
+	Date      string
+	Digest    []byte
+}
+
+// Digest canonicalizes payload (typically a JSON- or gob-encoded
+// datatypes.Message) by hashing it, so Sign/Verify operate on a fixed-size
+// value rather than the full request body.
+func Digest(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	return sum[:]
+}
+
+type hmacVerifier struct{ key []byte }
+
+func (v hmacVerifier) Verify(digest, signature []byte) error {
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write(digest)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type hmacSignator struct {
+	keyID string
+	key   []byte
+}
+
+func (s hmacSignator) KeyID() string { return s.keyID }
+
+func (s hmacSignator) Sign(digest []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(digest)
+	return mac.Sum(nil), nil
+}
+
+// NewSignator returns a Signator that HMAC-signs digests under keyID with
+// key.
+func NewSignator(keyID string, key []byte) Signator {
+	return hmacSignator{keyID: keyID, key: key}
+}
+
+// StaticKeystore is a Keystore backed by an in-memory keyID -> shared secret
+// map, for local development where packages all run on the same host.
+type StaticKeystore struct {
+	keys map[string][]byte
+}
+
+// NewStaticKeystore builds a StaticKeystore from a keyID -> shared secret
+// map.
+func NewStaticKeystore(keys map[string][]byte) *StaticKeystore {
+	return &StaticKeystore{keys: keys}
+}
+
+// LookupVerifier implements Keystore.
+func (s *StaticKeystore) LookupVerifier(ctx context.Context, keyID string) (
+	context.Context, Verifier, error) {
+	key, ok := s.keys[keyID]
+	if !ok {
+		return ctx, nil, ErrUnknownKey
+	}
+	return ctx, hmacVerifier{key: key}, nil
+}
+
+// LookupSignator implements Keystore.
+func (s *StaticKeystore) LookupSignator(ctx context.Context, keyID string) (
+	Signator, error) {
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return NewSignator(keyID, key), nil
+}
+
+// DBKeystore is a Keystore backed by the package_keys table, for production
+// where packages may run on other hosts and keys need to rotate without a
+// redeploy.
+type DBKeystore struct {
+	db *sqlx.DB
+}
+
+// NewDBKeystore returns a DBKeystore backed by db.
+func NewDBKeystore(db *sqlx.DB) *DBKeystore {
+	return &DBKeystore{db: db}
+}
+
+// LookupVerifier implements Keystore.
+func (s *DBKeystore) LookupVerifier(ctx context.Context, keyID string) (
+	context.Context, Verifier, error) {
+	key, err := s.secretKey(keyID)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, hmacVerifier{key: key}, nil
+}
+
+// LookupSignator implements Keystore.
+func (s *DBKeystore) LookupSignator(ctx context.Context, keyID string) (
+	Signator, error) {
+	key, err := s.secretKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return NewSignator(keyID, key), nil
+}
+
+func (s *DBKeystore) secretKey(keyID string) ([]byte, error) {
+	var key []byte
+	q := `
+		SELECT secretkey FROM package_keys
+		WHERE keyid=$1 AND revokedat IS NULL`
+	if err := s.db.Get(&key, q, keyID); err != nil {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
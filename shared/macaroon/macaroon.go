@@ -0,0 +1,237 @@
+// Package macaroon implements HMAC-chained macaroons: bearer tokens that
+// carry their own caveats (restrictions) and can be attenuated by anyone
+// holding them, but only verified by the holder of the root key. It backs
+// delegated, revocable authority for individual packages (see callPkg in
+// rpc.go) so a package can act on a user's behalf without holding the
+// user's full session.
+package macaroon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrCaveatNotSatisfied is returned by Verify when a first-party caveat in
+// the chain is not satisfied by any of the provided checks.
+var ErrCaveatNotSatisfied = errors.New("macaroon: caveat not satisfied")
+
+// ErrDischargeMissing is returned by Verify when a third-party caveat has no
+// matching (and valid) discharge macaroon in the provided set.
+var ErrDischargeMissing = errors.New("macaroon: missing or invalid discharge")
+
+// ErrBadSignature is returned by Verify when the recomputed HMAC chain
+// doesn't match the macaroon's signature, i.e. it was forged or tampered
+// with.
+var ErrBadSignature = errors.New("macaroon: signature mismatch")
+
+// Caveat restricts what a Macaroon authorizes. A first-party caveat (Location
+// empty) is a predicate checked directly by Verify, e.g. "user_id=42",
+// "route=billing_charge", "expires<1466812800". A third-party caveat names a
+// Location (the verifier that must discharge it, e.g. the auth package or a
+// payment provider) and a VID binding the eventual discharge macaroon back to
+// this one.
+type Caveat struct {
+	CID      string
+	Location string
+	VID      string
+}
+
+// Macaroon authorizes narrowly-scoped, time-bounded, caveat-restricted
+// access. Its Signature is an HMAC chain seeded from a root key known only to
+// the minting party and re-keyed by every caveat added after that.
+type Macaroon struct {
+	Identifier string
+	Location   string
+	Caveats    []Caveat
+	Signature  []byte
+}
+
+// New mints a root macaroon bound to rootKey and identifier (typically the
+// authorizing user or session id).
+func New(rootKey []byte, location, identifier string) *Macaroon {
+	h := hmac.New(sha256.New, rootKey)
+	h.Write([]byte(identifier))
+	return &Macaroon{
+		Identifier: identifier,
+		Location:   location,
+		Signature:  h.Sum(nil),
+	}
+}
+
+// WithFirstPartyCaveat returns a copy of m with predicate appended to the
+// caveat chain and the signature re-chained over it.
+func (m *Macaroon) WithFirstPartyCaveat(predicate string) *Macaroon {
+	return m.chain(Caveat{CID: predicate})
+}
+
+// WithThirdPartyCaveat returns a copy of m delegating verification of
+// predicate to location (e.g. the auth package). vid is derived from a key
+// shared with that third party and lets it mint a discharge macaroon that
+// Verify can tie back to this caveat.
+func (m *Macaroon) WithThirdPartyCaveat(location, predicate, vid string) *Macaroon {
+	return m.chain(Caveat{CID: predicate, Location: location, VID: vid})
+}
+
+func (m *Macaroon) chain(c Caveat) *Macaroon {
+	h := hmac.New(sha256.New, m.Signature)
+	h.Write([]byte(c.Location + c.CID + c.VID))
+	caveats := make([]Caveat, len(m.Caveats), len(m.Caveats)+1)
+	copy(caveats, m.Caveats)
+	return &Macaroon{
+		Identifier: m.Identifier,
+		Location:   m.Location,
+		Caveats:    append(caveats, c),
+		Signature:  h.Sum(nil),
+	}
+}
+
+// Discharge mints a discharge macaroon proving knowledge of key, the root key
+// shared between the minting party and the third-party verifier for a given
+// caveat's VID. Its identifier is the discharged caveat's CID so Verify can
+// match it back up.
+func Discharge(key []byte, caveatCID string) *Macaroon {
+	return New(key, "", caveatCID)
+}
+
+// Check evaluates a single first-party caveat predicate during Verify, e.g.
+// closing over the call's user id, route, and price so it can accept
+// predicates like "user_id=42" or reject "price_max<500".
+type Check func(predicate string) bool
+
+// KeyForVID recovers the shared key a third-party caveat's discharge was
+// minted with, given that caveat's VID. Verify uses it to validate the
+// discharge's own HMAC chain without ever seeing the caller's root key.
+type KeyForVID func(vid string) []byte
+
+// Verify walks root's caveat chain, recomputing the HMAC signature at each
+// step, and confirms every caveat is satisfied: first-party caveats against
+// checks, third-party caveats against a discharge macaroon (matched by CID)
+// in discharges whose own signature validates against the key named by
+// keyForVID. It rejects on the first unsatisfied or undischarged caveat, or
+// on any signature mismatch.
+func Verify(rootKey []byte, root *Macaroon, discharges []*Macaroon,
+	keyForVID KeyForVID, checks ...Check) error {
+	sig := rootSignature(rootKey, root.Identifier)
+	for _, c := range root.Caveats {
+		sig = chainSignature(sig, c)
+		if len(c.Location) == 0 {
+			if !satisfiesAny(c.CID, checks) {
+				return ErrCaveatNotSatisfied
+			}
+			continue
+		}
+		d := findDischarge(discharges, c.CID)
+		if d == nil {
+			return ErrDischargeMissing
+		}
+		key := keyForVID(c.VID)
+		if len(key) == 0 {
+			return ErrDischargeMissing
+		}
+		if err := verifyDischarge(key, d); err != nil {
+			return ErrDischargeMissing
+		}
+	}
+	if !hmac.Equal(sig, root.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func verifyDischarge(key []byte, d *Macaroon) error {
+	sig := rootSignature(key, d.Identifier)
+	for _, c := range d.Caveats {
+		sig = chainSignature(sig, c)
+	}
+	if !hmac.Equal(sig, d.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func rootSignature(key []byte, identifier string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(identifier))
+	return h.Sum(nil)
+}
+
+func chainSignature(sig []byte, c Caveat) []byte {
+	h := hmac.New(sha256.New, sig)
+	h.Write([]byte(c.Location + c.CID + c.VID))
+	return h.Sum(nil)
+}
+
+func findDischarge(discharges []*Macaroon, cid string) *Macaroon {
+	for _, d := range discharges {
+		if d.Identifier == cid {
+			return d
+		}
+	}
+	return nil
+}
+
+// PriceMaxCheck returns a Check that satisfies a "price_max<N" caveat when
+// price (in cents) is no more than N, so a macaroon minted for one call
+// can't be replayed to authorize a larger charge.
+func PriceMaxCheck(price uint64) Check {
+	return func(predicate string) bool {
+		if !strings.HasPrefix(predicate, "price_max<") {
+			return false
+		}
+		max := strings.TrimPrefix(predicate, "price_max<")
+		n, err := strconv.ParseUint(max, 10, 64)
+		if err != nil {
+			return false
+		}
+		return price <= n
+	}
+}
+
+// UserIDCheck returns a Check that satisfies a "user_id=N" caveat when it
+// names userID, so a macaroon minted for one user can't be presented on
+// another's behalf.
+func UserIDCheck(userID int) Check {
+	want := fmt.Sprintf("user_id=%d", userID)
+	return func(predicate string) bool {
+		return predicate == want
+	}
+}
+
+// RouteCheck returns a Check that satisfies a "route=X" caveat when it names
+// route, so a macaroon minted for one route can't be replayed against
+// another.
+func RouteCheck(route string) Check {
+	want := fmt.Sprintf("route=%s", route)
+	return func(predicate string) bool {
+		return predicate == want
+	}
+}
+
+// ExpiresCheck returns a Check that satisfies an "expires<N" caveat when N (a
+// unix timestamp) is still after now.
+func ExpiresCheck(now time.Time) Check {
+	return func(predicate string) bool {
+		if !strings.HasPrefix(predicate, "expires<") {
+			return false
+		}
+		n, err := strconv.ParseInt(strings.TrimPrefix(predicate, "expires<"), 10, 64)
+		if err != nil {
+			return false
+		}
+		return now.Unix() < n
+	}
+}
+
+func satisfiesAny(predicate string, checks []Check) bool {
+	for _, check := range checks {
+		if check(predicate) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package macaroon
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyGoodChain(t *testing.T) {
+	rootKey := []byte("root-key")
+	mac := New(rootKey, "ava", "42")
+	mac = mac.WithFirstPartyCaveat("user_id=42")
+	mac = mac.WithFirstPartyCaveat("route=billing_charge")
+	mac = mac.WithFirstPartyCaveat("expires<" + futureTimestamp())
+	mac = mac.WithFirstPartyCaveat("price_max<500")
+
+	err := Verify(rootKey, mac, nil, nil,
+		UserIDCheck(42),
+		RouteCheck("billing_charge"),
+		ExpiresCheck(time.Now()),
+		PriceMaxCheck(500))
+	if err != nil {
+		t.Fatalf("expected a valid macaroon to verify, got: %v", err)
+	}
+}
+
+func TestVerifyTamperedSignature(t *testing.T) {
+	rootKey := []byte("root-key")
+	mac := New(rootKey, "ava", "42")
+	mac = mac.WithFirstPartyCaveat("user_id=42")
+	mac.Signature[0] ^= 0xFF
+
+	err := Verify(rootKey, mac, nil, nil, UserIDCheck(42))
+	if err != ErrBadSignature {
+		t.Fatalf("expected ErrBadSignature, got: %v", err)
+	}
+}
+
+func TestVerifyMissingDischarge(t *testing.T) {
+	rootKey := []byte("root-key")
+	dischargeKey := []byte("discharge-key")
+	mac := New(rootKey, "ava", "42")
+	mac = mac.WithThirdPartyCaveat("auth", "zip=90210", "vid-1")
+
+	keyForVID := func(vid string) []byte {
+		if vid == "vid-1" {
+			return dischargeKey
+		}
+		return nil
+	}
+	err := Verify(rootKey, mac, nil, keyForVID)
+	if err != ErrDischargeMissing {
+		t.Fatalf("expected ErrDischargeMissing, got: %v", err)
+	}
+}
+
+func TestVerifyUnsatisfiedFirstPartyCaveat(t *testing.T) {
+	rootKey := []byte("root-key")
+	mac := New(rootKey, "ava", "42")
+	mac = mac.WithFirstPartyCaveat("user_id=42")
+
+	err := Verify(rootKey, mac, nil, nil, UserIDCheck(7))
+	if err != ErrCaveatNotSatisfied {
+		t.Fatalf("expected ErrCaveatNotSatisfied, got: %v", err)
+	}
+}
+
+func TestVerifyWithValidDischarge(t *testing.T) {
+	rootKey := []byte("root-key")
+	dischargeKey := []byte("discharge-key")
+	mac := New(rootKey, "ava", "42")
+	mac = mac.WithThirdPartyCaveat("auth", "zip=90210", "vid-1")
+
+	discharge := Discharge(dischargeKey, "zip=90210")
+	keyForVID := func(vid string) []byte {
+		if vid == "vid-1" {
+			return dischargeKey
+		}
+		return nil
+	}
+	err := Verify(rootKey, mac, []*Macaroon{discharge}, keyForVID)
+	if err != nil {
+		t.Fatalf("expected a valid discharge to verify, got: %v", err)
+	}
+}
+
+func TestPriceMaxCheckBoundary(t *testing.T) {
+	check := PriceMaxCheck(500)
+	cases := []struct {
+		predicate string
+		want      bool
+	}{
+		{"price_max<500", true},
+		{"price_max<501", true},
+		{"price_max<499", false},
+		{"price_max<0", false},
+		{"route=billing_charge", false},
+		{"price_max<not-a-number", false},
+	}
+	for _, c := range cases {
+		if got := check(c.predicate); got != c.want {
+			t.Errorf("PriceMaxCheck(500)(%q) = %v, want %v",
+				c.predicate, got, c.want)
+		}
+	}
+}
+
+func futureTimestamp() string {
+	return strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+}
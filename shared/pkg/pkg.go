@@ -0,0 +1,82 @@
+// Package pkg defines the types Ava's RPC dispatcher uses to register and
+// route StructuredInput to out-of-process packages.
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"net/rpc"
+
+	"github.com/avabot/ava/shared/httpsignature"
+)
+
+// ErrNotHandled is returned by a package's RPC method to tell callPkg "this
+// isn't mine" rather than "I matched but failed," letting dispatch fall
+// through to the next candidate in regPkgs (route -> shortRoute ->
+// last-response route) instead of aborting.
+var ErrNotHandled = errors.New("pkg: not handled")
+
+// Trigger lists the commands and objects that cause Ava to route
+// StructuredInput to this package.
+type Trigger struct {
+	Commands []string
+	Objects  []string
+}
+
+// Config describes how to reach and identify a registered package.
+type Config struct {
+	Name          string
+	Port          int
+	ServerAddress string
+
+	// KeyID names the key in Ava's httpsignature.Keystore that verifies
+	// this package's registration signature and, from then on, signs and
+	// verifies the RPC traffic exchanged with it.
+	KeyID string
+}
+
+// Pkg is what a package sends Ava.RegisterPackage to announce itself.
+type Pkg struct {
+	Config  Config
+	Trigger Trigger
+
+	// Signature proves whoever holds the key named by Config.KeyID
+	// produced this registration. RegisterPackage checks it against
+	// httpsignature.Digest(CanonicalBytes()) before dialing the package,
+	// so an attacker can't get Ava to rpc.Dial an arbitrary address just
+	// by claiming one.
+	Signature []byte
+}
+
+// CanonicalBytes returns a deterministic encoding of the package's identity,
+// suitable for signing and verifying Signature. It covers Config AND Trigger
+// - a tamperer who could rewrite Trigger without invalidating Signature could
+// hijack routing for commands/objects that belong to another, correctly
+// signed package - and deliberately excludes Signature itself.
+func (p *Pkg) CanonicalBytes() []byte {
+	b, _ := json.Marshal(struct {
+		Config  Config
+		Trigger Trigger
+	}{p.Config, p.Trigger})
+	return b
+}
+
+// PkgWrapper is what Ava's dispatcher keeps per registered package: the
+// announced Pkg, the live RPC connection used to call it, and the key
+// material used to sign outgoing calls and verify its replies.
+type PkgWrapper struct {
+	P         *Pkg
+	RPCClient *rpc.Client
+
+	// KeyID is Config.KeyID, kept alongside for convenience.
+	KeyID string
+
+	// Verifier checks signatures claiming to come from this package (its
+	// registration, and every RPC reply it sends back).
+	Verifier httpsignature.Verifier
+
+	// Signator signs every outgoing call Ava makes to this package. It is
+	// keyed specifically to this package, so a compromised package never
+	// learns the secret used to sign calls to any other package.
+	Signator httpsignature.Signator
+}
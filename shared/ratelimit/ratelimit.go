@@ -0,0 +1,104 @@
+// Package ratelimit enforces per-user, per-package, and per-route limits on
+// package dispatch, so a runaway SMS loop or a malicious Trigger collision
+// can't hammer downstream package RPCs or payment providers.
+package ratelimit
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateQuota configures a token bucket: Burst tokens refill toward a max of
+// Burst, at a rate of Requests per Duration.
+type RateQuota struct {
+	Burst    int
+	Requests int
+	Duration time.Duration
+}
+
+// DefaultUserQuota throttles a single user across all packages and routes.
+var DefaultUserQuota = RateQuota{Burst: 5, Requests: 20, Duration: time.Minute}
+
+// DefaultRouteQuota throttles a single (user, route) pair, e.g. to stop a
+// loop that keeps re-triggering the same package.
+var DefaultRouteQuota = RateQuota{Burst: 1, Requests: 1, Duration: time.Second}
+
+// DefaultPkgQuota throttles a single package across all users and routes,
+// e.g. to protect a package's own rate-limited upstream (Stripe, Twilio).
+var DefaultPkgQuota = RateQuota{Burst: 20, Requests: 100, Duration: time.Minute}
+
+// LoadQuota returns the RateQuota read from the burst/requests/duration
+// (seconds) env vars named by burstVar/requestsVar/durationVar, falling back
+// to def for any that are unset, so deployments can tune quotas without a
+// redeploy.
+func LoadQuota(burstVar, requestsVar, durationVar string, def RateQuota) (
+	RateQuota, error) {
+	q := def
+	if v := os.Getenv(burstVar); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return def, fmt.Errorf("ratelimit: invalid %s: %v", burstVar, err)
+		}
+		q.Burst = n
+	}
+	if v := os.Getenv(requestsVar); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return def, fmt.Errorf("ratelimit: invalid %s: %v", requestsVar, err)
+		}
+		q.Requests = n
+	}
+	if v := os.Getenv(durationVar); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return def, fmt.Errorf("ratelimit: invalid %s: %v", durationVar, err)
+		}
+		q.Duration = time.Duration(n) * time.Second
+	}
+	return q, nil
+}
+
+type bucket struct {
+	tokens   float64
+	lastFill time.Time
+}
+
+// Limiter is a set of independent token buckets, keyed by an arbitrary string
+// such as "user_id" or "user_id|route", all governed by the same RateQuota.
+type Limiter struct {
+	mu      sync.Mutex
+	quota   RateQuota
+	buckets map[string]*bucket
+}
+
+// NewLimiter returns a Limiter enforcing quota.
+func NewLimiter(quota RateQuota) *Limiter {
+	return &Limiter{quota: quota, buckets: map[string]*bucket{}}
+}
+
+// Allow reports whether a request keyed by key is permitted right now. If so
+// it consumes one token from that key's bucket.
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.quota.Burst), lastFill: now}
+		l.buckets[key] = b
+	}
+	rate := float64(l.quota.Requests) / l.quota.Duration.Seconds()
+	b.tokens += now.Sub(b.lastFill).Seconds() * rate
+	if b.tokens > float64(l.quota.Burst) {
+		b.tokens = float64(l.quota.Burst)
+	}
+	b.lastFill = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}